@@ -0,0 +1,95 @@
+package vfs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+
+	"vfs/db"
+)
+
+// BatchFileResult is the per-file outcome reported by BatchHashUploadHandler.
+type BatchFileResult struct {
+	Name    string `json:"name"`
+	Hash    string `json:"hash,omitempty"`
+	WebPath string `json:"webPath,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// BatchUploadResponse is the JSON envelope returned by BatchHashUploadHandler.
+type BatchUploadResponse struct {
+	Success bool              `json:"success"`
+	Files   []BatchFileResult `json:"files"`
+}
+
+// BatchHashUploadHandler accepts a single multipart POST carrying many
+// file parts, regardless of field name - any part with a non-empty
+// filename is treated as a file to upload, matching the pomf/uguu
+// multi-file upload protocol so existing client tooling (ShareX, curl
+// scripts) works against this module out of the box. Each file is
+// hash-uploaded independently; a failure on one file is recorded in that
+// file's result instead of aborting the rest of the batch.
+func (v VFS) BatchHashUploadHandler(hashRepo db.VfsHashRepo) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ns := r.FormValue("ns")
+
+		if err := r.ParseMultipartForm(v.cfg.MaxFileSize); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		resp := BatchUploadResponse{Success: true}
+
+		for _, headers := range r.MultipartForm.File {
+			for _, fh := range headers {
+				if fh.Filename == "" {
+					continue
+				}
+
+				resp.Files = append(resp.Files, v.batchUploadOne(r.Context(), ns, fh, hashRepo, &resp.Success))
+			}
+		}
+
+		b, err := json.Marshal(resp)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
+
+func (v VFS) batchUploadOne(ctx context.Context, ns string, fh *multipart.FileHeader, hashRepo db.VfsHashRepo, success *bool) BatchFileResult {
+	result := BatchFileResult{Name: fh.Filename, Size: fh.Size}
+
+	if fh.Size > v.cfg.MaxFileSize {
+		result.Error = fmt.Sprintf("file size exceed %v bytes", v.cfg.MaxFileSize)
+		*success = false
+		return result
+	}
+
+	file, err := fh.Open()
+	if err != nil {
+		result.Error = err.Error()
+		*success = false
+		return result
+	}
+	defer file.Close()
+
+	hash, err := v.HashUpload(ctx, file, ns, hashRepo)
+	if err != nil {
+		result.Error = err.Error()
+		*success = false
+		return result
+	}
+
+	result.Hash = string(hash)
+	result.WebPath = v.PublicURL(ns, hash)
+
+	return result
+}
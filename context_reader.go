@@ -0,0 +1,25 @@
+package vfs
+
+import (
+	"context"
+	"io"
+)
+
+// ctxReader wraps r so that Read returns ctx.Err() once the context is
+// cancelled or its deadline expires, letting long copies (uploads) unwind
+// promptly on client disconnect instead of running to completion.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func newCtxReader(ctx context.Context, r io.Reader) io.Reader {
+	return &ctxReader{ctx: ctx, r: r}
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
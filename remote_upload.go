@@ -0,0 +1,194 @@
+package vfs
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"vfs/db"
+)
+
+const defaultURLFetchTimeout = 10 * time.Second
+
+var errRemoteFileTooLarge = errors.New("vfs: remote file exceeds max file size")
+
+// HashUploadFromURL downloads rawURL and hash-uploads its body, mirroring
+// the multi-source upload style of pomf-family servers. The scheme must
+// be in Config.URLFetchAllowedSchemes (defaulting to "https" only); the
+// resolved host of the URL and of every redirect hop is checked against
+// RFC1918/loopback/link-local ranges to prevent SSRF against internal
+// services.
+func (v VFS) HashUploadFromURL(ctx context.Context, ns, rawURL string, repo db.VfsHashRepo) (FileHash, error) {
+	allowedSchemes := v.cfg.URLFetchAllowedSchemes
+	if len(allowedSchemes) == 0 {
+		allowedSchemes = []string{"https"}
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("vfs: invalid url: %w", err)
+	}
+
+	if err := validateScheme(u, allowedSchemes); err != nil {
+		return "", err
+	}
+
+	client := &http.Client{
+		Timeout:   defaultURLFetchTimeout,
+		Transport: &http.Transport{DialContext: ssrfSafeDialContext},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("vfs: too many redirects")
+			}
+			return validateScheme(req.URL, allowedSchemes)
+		},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vfs: fetching %s returned status %d", rawURL, resp.StatusCode)
+	}
+
+	if resp.ContentLength > 0 && resp.ContentLength > v.cfg.MaxFileSize {
+		return "", errRemoteFileTooLarge
+	}
+
+	// actually stop reading at the limit, rather than merely noticing
+	// after the fact, so a malicious/misconfigured remote can't fill the
+	// disk (or rack up S3 storage) by serving an unbounded body.
+	limited := io.LimitReader(resp.Body, v.cfg.MaxFileSize+1)
+
+	fh, err := v.HashUpload(ctx, limited, ns, repo)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := v.storage.Stat(ctx, ns, fh.File())
+	if err == nil && info.Size() > v.cfg.MaxFileSize {
+		_ = v.Delete(ctx, ns, fh, repo)
+		return "", errRemoteFileTooLarge
+	}
+
+	return fh, nil
+}
+
+// validateScheme rejects schemes outside allowedSchemes. Host validation
+// happens separately, at dial time (see ssrfSafeDialContext), since
+// checking it here and connecting later would leave a DNS-rebinding
+// window between the two lookups.
+func validateScheme(u *url.URL, allowedSchemes []string) error {
+	for _, s := range allowedSchemes {
+		if strings.EqualFold(s, u.Scheme) {
+			return nil
+		}
+	}
+	return fmt.Errorf("vfs: scheme %q is not allowed", u.Scheme)
+}
+
+// isDisallowedRemoteIP reports whether ip must not be reached by the
+// remote-URL fetcher: loopback, link-local, private (RFC1918 and IPv6
+// unique-local) or unspecified addresses. Other non-public ranges, such as
+// multicast or carrier-grade NAT space, are not rejected.
+func isDisallowedRemoteIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsPrivate() || ip.IsUnspecified()
+}
+
+// ssrfSafeDialContext is used as the http.Transport's DialContext for
+// remote-URL fetches. It resolves the host itself and dials the validated
+// IP directly, rather than relying on a separate pre-flight net.LookupIP
+// followed by the transport resolving (and potentially getting a
+// different answer for) the hostname again - closing the DNS-rebinding
+// TOCTOU gap that a standalone validation step would leave open.
+func ssrfSafeDialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("vfs: resolving %q: %w", host, err)
+	}
+
+	var dialer net.Dialer
+	var lastErr error
+	for _, a := range addrs {
+		if isDisallowedRemoteIP(a.IP) {
+			lastErr = fmt.Errorf("vfs: host %q resolves to a disallowed address %s", host, a.IP)
+			continue
+		}
+
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(a.IP.String(), port))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return conn, nil
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("vfs: no usable address for %q", host)
+	}
+	return nil, lastErr
+}
+
+// dataURIReader streams the decoded payload of a "data:[mediatype];base64,<data>"
+// URI without buffering the whole payload in memory.
+func dataURIReader(uri string) (io.Reader, error) {
+	const prefix = "data:"
+	if !strings.HasPrefix(uri, prefix) {
+		return nil, errors.New("vfs: not a data URI")
+	}
+
+	comma := strings.IndexByte(uri, ',')
+	if comma < 0 {
+		return nil, errors.New("vfs: malformed data URI")
+	}
+
+	meta, data := uri[len(prefix):comma], uri[comma+1:]
+	if !strings.Contains(meta, ";base64") {
+		return nil, errors.New("vfs: only base64 data URIs are supported")
+	}
+
+	return base64.NewDecoder(base64.StdEncoding, strings.NewReader(data)), nil
+}
+
+func (v VFS) uploadFromURL(ctx context.Context, ns, rawURL string, hashRepo db.VfsHashRepo) UploadResponse {
+	hash, err := v.HashUploadFromURL(ctx, ns, rawURL, hashRepo)
+	if err != nil {
+		return UploadResponse{Error: err.Error(), Code: http.StatusBadRequest}
+	}
+
+	return UploadResponse{Code: http.StatusOK, Hash: string(hash), WebPath: v.PublicURL(ns, hash)}
+}
+
+func (v VFS) uploadFromDataURI(ctx context.Context, ns, dataURI string, hashRepo db.VfsHashRepo) UploadResponse {
+	r, err := dataURIReader(dataURI)
+	if err != nil {
+		return UploadResponse{Error: err.Error(), Code: http.StatusBadRequest}
+	}
+
+	hash, err := v.HashUpload(ctx, r, ns, hashRepo)
+	if err != nil {
+		return UploadResponse{Error: err.Error(), Code: http.StatusBadRequest}
+	}
+
+	return UploadResponse{Code: http.StatusOK, Hash: string(hash), WebPath: v.PublicURL(ns, hash)}
+}
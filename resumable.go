@@ -0,0 +1,256 @@
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"vfs/db"
+)
+
+const (
+	resumableKeyPrefix = ".resumable/"
+	resumableTTL       = 24 * time.Hour
+)
+
+// resumableUploadID generates the id used both as the storage key and as
+// the bearer token a client presents on every PATCH until the upload
+// completes, so unlike randSeq's temp filenames it must not be guessable.
+func resumableUploadID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ResumableUploadHandler implements the upload half of the tus 1.0
+// protocol on top of the existing Storage backends: POST /uploads with
+// an Upload-Length header creates a staged upload and returns its
+// Location; HEAD /uploads/{id} reports the current Upload-Offset; PATCH
+// /uploads/{id} appends bytes at the given Upload-Offset, rejecting a
+// mismatched offset with 409. Once the offset reaches the declared
+// length, the staged bytes are fed through HashUpload (or createFile, if
+// folderId was given at creation) and the upload record is removed.
+func (v VFS) ResumableUploadHandler(repo db.VfsRepo, hashRepo db.VfsHashRepo, uploads db.VfsUploadRepo) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			v.createResumableUpload(w, r, uploads)
+		case http.MethodHead:
+			v.resumableUploadStatus(w, r, uploads)
+		case http.MethodPatch:
+			v.appendResumableUpload(w, r, repo, hashRepo, uploads)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func (v VFS) createResumableUpload(w http.ResponseWriter, r *http.Request, uploads db.VfsUploadRepo) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		http.Error(w, "bad Upload-Length", http.StatusBadRequest)
+		return
+	}
+
+	if length > v.cfg.MaxFileSize {
+		http.Error(w, "file size exceeds limit", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	ns := r.FormValue("ns")
+	if !v.IsValidNamespace(ns) {
+		http.Error(w, ErrInvalidNamespace.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var folderID int
+	if raw := r.FormValue("folderId"); raw != "" {
+		var err error
+		folderID, err = strconv.Atoi(raw)
+		if err != nil {
+			http.Error(w, "bad folder "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	id, err := resumableUploadID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := v.storage.Put(r.Context(), NamespacePublic, resumableKeyPrefix+id, bytes.NewReader(nil)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	up := &db.VfsUpload{
+		ID:        id,
+		NS:        ns,
+		FolderID:  folderID,
+		Length:    length,
+		Offset:    0,
+		ExpiresAt: time.Now().Add(resumableTTL),
+	}
+	if err := uploads.CreateUpload(r.Context(), up); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", path.Join("/uploads", id))
+	w.Header().Set("Upload-Offset", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (v VFS) resumableUploadStatus(w http.ResponseWriter, r *http.Request, uploads db.VfsUploadRepo) {
+	id := path.Base(r.URL.Path)
+
+	up, err := uploads.GetUpload(r.Context(), id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if up == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(up.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(up.Length, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (v VFS) appendResumableUpload(w http.ResponseWriter, r *http.Request, repo db.VfsRepo, hashRepo db.VfsHashRepo, uploads db.VfsUploadRepo) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "unsupported Content-Type", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	id := path.Base(r.URL.Path)
+
+	up, err := uploads.GetUpload(ctx, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if up == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != up.Offset {
+		http.Error(w, "offset mismatch", http.StatusConflict)
+		return
+	}
+
+	key := resumableKeyPrefix + id
+
+	// a cheap Stat confirms the staged file is where the DB thinks it is
+	// before appending, without paying to read its bytes back.
+	info, err := v.storage.Stat(ctx, NamespacePublic, key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if info.Size() != offset {
+		http.Error(w, "offset mismatch", http.StatusConflict)
+		return
+	}
+
+	// stream this chunk onto the end of the staged file. On localStorage
+	// that is a plain append, O(chunk); the S3 and SeaweedFS backends have
+	// no native append and rewrite the whole object (see Storage.Append).
+	newOffset, err := v.storage.Append(ctx, NamespacePublic, key, io.LimitReader(r.Body, up.Length-offset))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := uploads.UpdateOffset(ctx, id, newOffset); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+
+	if newOffset < up.Length {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if err := v.completeResumableUpload(ctx, up, repo, hashRepo); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_ = v.storage.Remove(ctx, NamespacePublic, key)
+	_ = uploads.DeleteUpload(ctx, id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (v VFS) completeResumableUpload(ctx context.Context, up *db.VfsUpload, repo db.VfsRepo, hashRepo db.VfsHashRepo) error {
+	final, err := v.storage.Get(ctx, NamespacePublic, resumableKeyPrefix+up.ID)
+	if err != nil {
+		return err
+	}
+	defer final.Close()
+
+	if up.FolderID == 0 {
+		_, err := v.HashUpload(ctx, final, up.NS, hashRepo)
+		return err
+	}
+
+	folder, err := repo.VfsFolderByID(ctx, up.FolderID)
+	if err != nil {
+		return err
+	} else if folder == nil {
+		return fmt.Errorf("vfs: folder %d not found", up.FolderID)
+	}
+
+	tempFile := "temp" + randSeq(16)
+	if err := v.Upload(ctx, final, tempFile, up.NS); err != nil {
+		return err
+	}
+
+	_, err = v.createFile(ctx, repo, folder, up.NS, tempFile, "", "")
+	return err
+}
+
+// ResumableJanitor removes resumable uploads whose ExpiresAt has passed
+// along with their staged bytes. Callers are expected to invoke this
+// periodically (e.g. from a ticker running alongside the HTTP server),
+// since interrupted uploads otherwise never get cleaned up.
+func (v VFS) ResumableJanitor(ctx context.Context, uploads db.VfsUploadRepo) error {
+	expired, err := uploads.ListExpiredUploads(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+
+	// removing one expired upload must not block cleanup of the rest, so
+	// keep going and report only the last error encountered. A staged file
+	// that is already gone does not keep its record from being deleted.
+	var lastErr error
+	for _, up := range expired {
+		if err := v.storage.Remove(ctx, NamespacePublic, resumableKeyPrefix+up.ID); err != nil && !os.IsNotExist(err) {
+			lastErr = err
+			continue
+		}
+		if err := uploads.DeleteUpload(ctx, up.ID); err != nil {
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
@@ -0,0 +1,68 @@
+package vfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	StorageDriverLocal     = "local"
+	StorageDriverS3        = "s3"
+	StorageDriverSeaweedFS = "seaweedfs"
+)
+
+// Storage abstracts every disk-touching operation VFS performs so that
+// uploaded files can live on a local POSIX volume, in S3 (or any
+// S3-compatible endpoint such as MinIO) or in SeaweedFS, selected through
+// Config.StorageDriver/Config.StorageSource. Callers never talk to the
+// filesystem directly; they go through this interface instead.
+type Storage interface {
+	// Put writes the contents of r to ns/key, creating any intermediate
+	// directories the backend needs.
+	Put(ctx context.Context, ns, key string, r io.Reader) error
+
+	// Append adds r's bytes to the end of the already-existing ns/key and
+	// returns the key's total size afterwards; it errors if ns/key does
+	// not already exist. It exists for resumable uploads, so each chunk
+	// can be written without re-reading and rewriting everything staged
+	// so far. Only localStorage can do this cheaply (a seek-append on the
+	// staged file); S3 and SeaweedFS have no native append and fall back
+	// to reading the whole object back and rewriting it, so callers on
+	// those backends should expect O(total staged bytes) per call.
+	Append(ctx context.Context, ns, key string, r io.Reader) (int64, error)
+
+	// Get opens ns/key for reading.
+	Get(ctx context.Context, ns, key string) (io.ReadCloser, error)
+
+	// Rename moves ns/oldKey to ns/newKey.
+	Rename(ctx context.Context, ns, oldKey, newKey string) error
+
+	// Remove deletes ns/key.
+	Remove(ctx context.Context, ns, key string) error
+
+	// Stat returns file info for ns/key.
+	Stat(ctx context.Context, ns, key string) (os.FileInfo, error)
+
+	// PublicURL returns a URL a client can use to fetch the hashed file
+	// directly: a static path under Config.WebPath for LocalStorage, or
+	// a presigned/CDN URL for cloud backends.
+	PublicURL(ns string, h FileHash) string
+}
+
+// NewStorage builds the Storage backend selected by cfg.StorageDriver. An
+// empty driver defaults to StorageDriverLocal, matching the pre-existing
+// single-volume behavior.
+func NewStorage(cfg Config) (Storage, error) {
+	switch cfg.StorageDriver {
+	case "", StorageDriverLocal:
+		return newLocalStorage(cfg)
+	case StorageDriverS3:
+		return newS3Storage(cfg)
+	case StorageDriverSeaweedFS:
+		return newSeaweedFSStorage(cfg)
+	default:
+		return nil, fmt.Errorf("vfs: unknown storage driver %q", cfg.StorageDriver)
+	}
+}
@@ -0,0 +1,108 @@
+package vfs
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// localStorage is the original single-volume backend: files live under
+// cfg.Path on local disk and are served from cfg.WebPath.
+type localStorage struct {
+	path    string
+	webPath string
+}
+
+func newLocalStorage(cfg Config) (Storage, error) {
+	if _, err := os.Stat(cfg.Path); os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return &localStorage{path: cfg.Path, webPath: cfg.WebPath}, nil
+}
+
+func (s *localStorage) fullPath(ns, key string) string {
+	return filepath.Join(s.path, ns, key)
+}
+
+func (s *localStorage) Put(ctx context.Context, ns, key string, r io.Reader) error {
+	full := s.fullPath(ns, key)
+	if err := os.MkdirAll(filepath.Dir(full), defaultModePerm); err != nil {
+		return err
+	}
+
+	f, err := os.Create(full)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, newCtxReader(ctx, r)); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+func (s *localStorage) Append(ctx context.Context, ns, key string, r io.Reader) (int64, error) {
+	full := s.fullPath(ns, key)
+
+	f, err := os.OpenFile(full, os.O_WRONLY|os.O_APPEND, defaultModePerm)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	before, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := io.Copy(f, newCtxReader(ctx, r)); err != nil {
+		// a partial write must not leave the file longer than the caller
+		// (and whatever offset it has durably recorded) believes it is,
+		// or every retry after this one sees a permanent offset mismatch.
+		_ = f.Truncate(before.Size())
+		return 0, err
+	}
+
+	if err := f.Sync(); err != nil {
+		_ = f.Truncate(before.Size())
+		return 0, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+func (s *localStorage) Get(ctx context.Context, ns, key string) (io.ReadCloser, error) {
+	return os.Open(s.fullPath(ns, key))
+}
+
+func (s *localStorage) Rename(ctx context.Context, ns, oldKey, newKey string) error {
+	oldFull, newFull := s.fullPath(ns, oldKey), s.fullPath(ns, newKey)
+
+	if err := os.MkdirAll(filepath.Dir(newFull), defaultModePerm); err != nil {
+		return err
+	}
+
+	return os.Rename(oldFull, newFull)
+}
+
+func (s *localStorage) Remove(ctx context.Context, ns, key string) error {
+	return os.Remove(s.fullPath(ns, key))
+}
+
+func (s *localStorage) Stat(ctx context.Context, ns, key string) (os.FileInfo, error) {
+	return os.Stat(s.fullPath(ns, key))
+}
+
+func (s *localStorage) PublicURL(ns string, h FileHash) string {
+	return path.Join(s.webPath, ns, h.File())
+}
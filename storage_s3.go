@@ -0,0 +1,223 @@
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// s3DSN is the parsed form of Config.StorageSource for the s3 driver,
+// e.g. "https://minio.internal/my-bucket?region=us-east-1&accessKey=K&secretKey=S".
+type s3DSN struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+}
+
+func parseS3DSN(source string) (s3DSN, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return s3DSN{}, fmt.Errorf("vfs: invalid s3 storage source: %w", err)
+	}
+
+	parts := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	if parts[0] == "" {
+		return s3DSN{}, fmt.Errorf("vfs: s3 storage source %q is missing a bucket", source)
+	}
+
+	q := u.Query()
+	region := q.Get("region")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	u.Path = ""
+	u.RawQuery = ""
+
+	return s3DSN{
+		endpoint:  u.String(),
+		bucket:    parts[0],
+		region:    region,
+		accessKey: q.Get("accessKey"),
+		secretKey: q.Get("secretKey"),
+	}, nil
+}
+
+func newReadSeekerBytes(b []byte) io.ReadSeeker {
+	return bytes.NewReader(b)
+}
+
+// s3Storage stores files in an S3 bucket. cfg.StorageSource is a DSN of
+// the form "endpoint/bucket?region=R&accessKey=K&secretKey=S", which lets
+// the same driver talk to AWS S3 or a self-hosted, S3-compatible endpoint
+// such as MinIO (path-style addressing is always forced on, since that's
+// what MinIO requires).
+type s3Storage struct {
+	bucket  string
+	webBase string
+	client  *s3.S3
+}
+
+func newS3Storage(cfg Config) (Storage, error) {
+	dsn, err := parseS3DSN(cfg.StorageSource)
+	if err != nil {
+		return nil, err
+	}
+
+	awsCfg := aws.NewConfig().
+		WithRegion(dsn.region).
+		WithS3ForcePathStyle(true)
+
+	if dsn.endpoint != "" {
+		awsCfg = awsCfg.WithEndpoint(dsn.endpoint)
+	}
+	if dsn.accessKey != "" {
+		awsCfg = awsCfg.WithCredentials(credentials.NewStaticCredentials(dsn.accessKey, dsn.secretKey, ""))
+	}
+
+	sess, err := session.NewSession(awsCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3Storage{
+		bucket:  dsn.bucket,
+		webBase: cfg.WebPath,
+		client:  s3.New(sess),
+	}, nil
+}
+
+func (s *s3Storage) key(ns, key string) string {
+	if ns == NamespacePublic {
+		return key
+	}
+	return ns + "/" + key
+}
+
+func (s *s3Storage) Put(ctx context.Context, ns, key string, r io.Reader) error {
+	buf, err := ioutil.ReadAll(newCtxReader(ctx, r))
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(ns, key)),
+		Body:   newReadSeekerBytes(buf),
+	})
+	return err
+}
+
+func (s *s3Storage) Append(ctx context.Context, ns, key string, r io.Reader) (int64, error) {
+	// S3 has no native append, and a real multipart-upload session would
+	// need an UploadId tracked across requests that this driver has
+	// nowhere to persist, so the existing object is read back and
+	// rewritten with the new bytes tacked on.
+	existing, err := s.Get(ctx, ns, key)
+	if err != nil {
+		return 0, err
+	}
+	buf, err := ioutil.ReadAll(existing)
+	existing.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	chunk, err := ioutil.ReadAll(newCtxReader(ctx, r))
+	if err != nil {
+		return 0, err
+	}
+	buf = append(buf, chunk...)
+
+	if err := s.Put(ctx, ns, key, bytes.NewReader(buf)); err != nil {
+		return 0, err
+	}
+
+	return int64(len(buf)), nil
+}
+
+func (s *s3Storage) Get(ctx context.Context, ns, key string) (io.ReadCloser, error) {
+	out, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(ns, key)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+func (s *s3Storage) Rename(ctx context.Context, ns, oldKey, newKey string) error {
+	src := fmt.Sprintf("%s/%s", s.bucket, s.key(ns, oldKey))
+
+	if _, err := s.client.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(s.bucket),
+		CopySource: aws.String(src),
+		Key:        aws.String(s.key(ns, newKey)),
+	}); err != nil {
+		return err
+	}
+
+	return s.Remove(ctx, ns, oldKey)
+}
+
+func (s *s3Storage) Remove(ctx context.Context, ns, key string) error {
+	_, err := s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(ns, key)),
+	})
+	return err
+}
+
+func (s *s3Storage) Stat(ctx context.Context, ns, key string) (os.FileInfo, error) {
+	out, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(ns, key)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3FileInfo{key: key, size: aws.Int64Value(out.ContentLength), modTime: aws.TimeValue(out.LastModified)}, nil
+}
+
+func (s *s3Storage) PublicURL(ns string, h FileHash) string {
+	req, _ := s.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(ns, h.File())),
+	})
+
+	if url, err := req.Presign(15 * time.Minute); err == nil {
+		return url
+	}
+
+	return s.webBase + "/" + s.key(ns, h.File())
+}
+
+// s3FileInfo is the minimal os.FileInfo needed by callers of Stat; S3
+// objects have no mode/owner concept so those methods return zero values.
+type s3FileInfo struct {
+	key     string
+	size    int64
+	modTime time.Time
+}
+
+func (i *s3FileInfo) Name() string       { return i.key }
+func (i *s3FileInfo) Size() int64        { return i.size }
+func (i *s3FileInfo) Mode() os.FileMode  { return 0 }
+func (i *s3FileInfo) ModTime() time.Time { return i.modTime }
+func (i *s3FileInfo) IsDir() bool        { return false }
+func (i *s3FileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,243 @@
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/sync/singleflight"
+
+	"vfs/db"
+)
+
+// fileHashPattern matches the lowercase hex md5 digest HashUpload produces;
+// FileHash.Dir slices the first three characters unconditionally, so
+// anything shorter must be rejected before it ever reaches a FileHash method.
+var fileHashPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// ThumbnailSize is one (width, height) pair callers are allowed to
+// request; Config.AllowedThumbnailSizes whitelists every size
+// ThumbnailHandler will generate, so a client can't force arbitrary
+// resizes of a viral image.
+type ThumbnailSize struct {
+	W, H int
+}
+
+const (
+	thumbnailFitCover   = "cover"
+	thumbnailFitContain = "contain"
+)
+
+var thumbnailGroup singleflight.Group
+
+// ThumbnailHandler serves /thumb/{ns}/{hash}?w=NNN&h=NNN&fit=cover|contain.
+// The source is read from storage at FileHash.File, decoded, resized and written out as
+// JPEG with a long-lived Cache-Control header. Results are cached on first
+// request under a sibling "thumbs/<w>x<h>/<fit>/<hash>.jpg" tree so a
+// second request for the same size and fit is served without resizing
+// again; concurrent requests for the same not-yet-cached size and fit
+// are coalesced with a singleflight group so a viral image doesn't spawn
+// N concurrent resizes.
+func (v VFS) ThumbnailHandler(repo db.VfsRepo) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ns, hash, ok := parseThumbnailPath(r.URL.Path)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		if !v.IsValidNamespace(ns) {
+			http.Error(w, ErrInvalidNamespace.Error(), http.StatusBadRequest)
+			return
+		}
+		if !fileHashPattern.MatchString(hash) {
+			http.Error(w, "bad hash", http.StatusBadRequest)
+			return
+		}
+
+		size, fit, err := v.parseThumbnailRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		etag := fmt.Sprintf(`"%s-%dx%d-%s"`, hash, size.W, size.H, fit)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		data, err := v.getOrCreateThumbnail(r.Context(), ns, FileHash(hash), size, fit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Write(data)
+	}
+}
+
+// parseThumbnailPath extracts ns and hash from a /thumb/{ns}/{hash} path.
+func parseThumbnailPath(p string) (ns, hash string, ok bool) {
+	p = strings.TrimPrefix(p, "/thumb/")
+	parts := strings.SplitN(p, "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
+
+func (v VFS) parseThumbnailRequest(r *http.Request) (ThumbnailSize, string, error) {
+	w, err := strconv.Atoi(r.FormValue("w"))
+	if err != nil {
+		return ThumbnailSize{}, "", fmt.Errorf("bad w: %w", err)
+	}
+
+	h, err := strconv.Atoi(r.FormValue("h"))
+	if err != nil {
+		return ThumbnailSize{}, "", fmt.Errorf("bad h: %w", err)
+	}
+
+	size := ThumbnailSize{W: w, H: h}
+
+	allowed := false
+	for _, s := range v.cfg.AllowedThumbnailSizes {
+		if s == size {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return ThumbnailSize{}, "", fmt.Errorf("thumbnail size %dx%d is not allowed", w, h)
+	}
+
+	fit := r.FormValue("fit")
+	if fit == "" {
+		fit = thumbnailFitCover
+	}
+	if fit != thumbnailFitCover && fit != thumbnailFitContain {
+		return ThumbnailSize{}, "", fmt.Errorf("bad fit %q", fit)
+	}
+
+	return size, fit, nil
+}
+
+func thumbnailKey(size ThumbnailSize, fit string, h FileHash) string {
+	return fmt.Sprintf("thumbs/%dx%d/%s/%s.jpg", size.W, size.H, fit, h)
+}
+
+func (v VFS) getOrCreateThumbnail(ctx context.Context, ns string, h FileHash, size ThumbnailSize, fit string) ([]byte, error) {
+	key := thumbnailKey(size, fit, h)
+
+	if r, err := v.storage.Get(ctx, ns, key); err == nil {
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+
+	data, err, _ := thumbnailGroup.Do(ns+"/"+key, func() (interface{}, error) {
+		return v.renderThumbnail(ctx, ns, h, size, fit)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return data.([]byte), nil
+}
+
+func (v VFS) renderThumbnail(ctx context.Context, ns string, h FileHash, size ThumbnailSize, fit string) ([]byte, error) {
+	src, err := v.storage.Get(ctx, ns, h.File())
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	// bound the decode input so a maliciously huge "source" can't be used
+	// to exhaust memory through the thumbnail pipeline.
+	img, _, err := image.Decode(io.LimitReader(src, 64<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := img.Bounds()
+	if size.W > bounds.Dx() || size.H > bounds.Dy() {
+		return nil, fmt.Errorf("vfs: requested thumbnail %dx%d exceeds source dimensions %dx%d", size.W, size.H, bounds.Dx(), bounds.Dy())
+	}
+
+	dstRect := image.Rect(0, 0, size.W, size.H)
+	dst := image.NewRGBA(dstRect)
+
+	switch fit {
+	case thumbnailFitContain:
+		// scale to fit entirely inside dstRect, preserving aspect ratio,
+		// and letterbox it (centered, with the rest of dst left blank)
+		// rather than stretching the source to fill it.
+		draw.CatmullRom.Scale(dst, containRect(dstRect, bounds), img, bounds, draw.Src, nil)
+	default: // cover
+		// crop the source to dstRect's aspect ratio first, then scale
+		// that crop to fill dstRect exactly, so the result isn't
+		// distorted and nothing outside the crop leaks into the thumbnail.
+		draw.CatmullRom.Scale(dst, dstRect, img, coverCropRect(bounds, size.W, size.H), draw.Src, nil)
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85}); err != nil {
+		return nil, err
+	}
+
+	if err := v.storage.Put(ctx, ns, thumbnailKey(size, fit, h), bytes.NewReader(buf.Bytes())); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// containRect returns the sub-rectangle of dst that the source should be
+// scaled into so it fits entirely within dst without distortion, centered
+// on whichever axis has slack.
+func containRect(dst image.Rectangle, src image.Rectangle) image.Rectangle {
+	scale := float64(dst.Dx()) / float64(src.Dx())
+	if s := float64(dst.Dy()) / float64(src.Dy()); s < scale {
+		scale = s
+	}
+
+	w := int(float64(src.Dx())*scale + 0.5)
+	h := int(float64(src.Dy())*scale + 0.5)
+
+	x0 := dst.Min.X + (dst.Dx()-w)/2
+	y0 := dst.Min.Y + (dst.Dy()-h)/2
+
+	return image.Rect(x0, y0, x0+w, y0+h)
+}
+
+// coverCropRect returns the largest sub-rectangle of src, centered, whose
+// aspect ratio matches dstW:dstH, so scaling that crop onto a dstW x dstH
+// rectangle fills it completely with no distortion and no letterboxing.
+func coverCropRect(src image.Rectangle, dstW, dstH int) image.Rectangle {
+	srcAspect := float64(src.Dx()) / float64(src.Dy())
+	dstAspect := float64(dstW) / float64(dstH)
+
+	w, h := src.Dx(), src.Dy()
+	if srcAspect > dstAspect {
+		w = int(float64(h)*dstAspect + 0.5)
+	} else {
+		h = int(float64(w)/dstAspect + 0.5)
+	}
+
+	x0 := src.Min.X + (src.Dx()-w)/2
+	y0 := src.Min.Y + (src.Dy()-h)/2
+
+	return image.Rect(x0, y0, x0+w, y0+h)
+}
@@ -1,6 +1,7 @@
 package vfs
 
 import (
+	"bytes"
 	"context"
 	"crypto/md5"
 	"encoding/hex"
@@ -33,6 +34,12 @@ const (
 	DefaultHashExtension = "jpg"
 	NamespacePublic      = ""
 	defaultModePerm      = os.ModePerm
+
+	// sniffBufferSize bounds how much of an uploaded file createFile reads
+	// to detect its image dimensions and mime type; both mimetype.DetectReader
+	// and image.DecodeConfig only ever look at the first few KB of a file,
+	// so there is no need to buffer the whole thing in memory.
+	sniffBufferSize = 512 << 10
 )
 
 var ErrInvalidNamespace = errors.New("invalid namespace")
@@ -55,130 +62,119 @@ type Config struct {
 	Namespaces      []string
 	UploadFormName  string
 	SaltedFilenames bool
+
+	// StorageDriver selects the Storage backend ("local", "s3" or
+	// "seaweedfs"); it defaults to "local". StorageSource is the
+	// backend-specific connection string (unused for "local").
+	StorageDriver string
+	StorageSource string
+
+	// AllowedThumbnailSizes whitelists the (w,h) pairs ThumbnailHandler
+	// is willing to generate.
+	AllowedThumbnailSizes []ThumbnailSize
+
+	// URLFetchAllowedSchemes whitelists the URL schemes HashUploadFromURL
+	// will fetch; it defaults to []string{"https"}.
+	URLFetchAllowedSchemes []string
 }
 
 type VFS struct {
-	cfg Config
+	cfg     Config
+	storage Storage
 }
 
 func New(cfg Config) (VFS, error) {
-	if _, err := os.Stat(cfg.Path); os.IsNotExist(err) {
-		return VFS{}, err
-	}
-
 	if cfg.UploadFormName == "" {
 		cfg.UploadFormName = "file"
 	}
 
-	return VFS{cfg: cfg}, nil
-}
-
-func (v VFS) Upload(r io.Reader, relFilename, ns string) error {
-	fileDir := filepath.Dir(filepath.Join(v.cfg.Path, ns, relFilename))
-	err := os.MkdirAll(fileDir, defaultModePerm)
-	if err != nil {
-		return err
-	}
-
-	f, err := os.Create(filepath.Join(v.cfg.Path, ns, relFilename))
+	storage, err := NewStorage(cfg)
 	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	if _, err := io.Copy(f, r); err != nil {
-		return err
+		return VFS{}, err
 	}
 
-	return f.Sync()
+	return VFS{cfg: cfg, storage: storage}, nil
 }
 
-func (v VFS) Move(ns, currentPath, newPath string) error {
-	currentPath = filepath.Join(v.cfg.Path, ns, currentPath)
-	newPath = filepath.Join(v.cfg.Path, ns, newPath)
-
-	err := os.MkdirAll(filepath.Dir(newPath), defaultModePerm)
-	if err != nil {
-		return err
-	}
+func (v VFS) Upload(ctx context.Context, r io.Reader, relFilename, ns string) error {
+	return v.storage.Put(ctx, ns, relFilename, r)
+}
 
-	return os.Rename(currentPath, newPath)
+func (v VFS) Move(ctx context.Context, ns, currentPath, newPath string) error {
+	return v.storage.Rename(ctx, ns, currentPath, newPath)
 }
 
-func (v VFS) HashUpload(r io.Reader, ns string) (fh FileHash, err error) {
+// HashUpload stores r as a content-addressed file under ns: identical
+// content uploaded more than once, even through different VfsFolders, is
+// kept on disk exactly once. repo tracks a refcount per (hash, ns) pair
+// so the backing file is only removed once the last reference is gone
+// (see Delete). The upload is staged under a private temp key first and
+// only moved into its final hashed key once UpsertHashRef confirms this
+// is the first time that hash has been seen in ns; a duplicate upload's
+// bytes are discarded instead, since the hashed key is shared by every
+// reference and must never be touched except by the reference that
+// created it.
+func (v VFS) HashUpload(ctx context.Context, r io.Reader, ns string, repo db.VfsHashRepo) (fh FileHash, err error) {
 	if !v.IsValidNamespace(ns) {
 		return "", ErrInvalidNamespace
 	}
 
-	tf, err := ioutil.TempFile(v.cfg.Path, "vfs")
-	if err != nil {
+	tmpKey := ".vfs-tmp/" + randSeq(16)
+
+	hash := md5.New()
+	if err := v.storage.Put(ctx, ns, tmpKey, io.TeeReader(r, hash)); err != nil {
 		return "", err
 	}
 
-	deleteTempFile, tempFilename := true, tf.Name()
-
-	// close and delete file if needed
-	defer func() {
-		fErr := tf.Close()
-		if err == nil && fErr != nil {
-			err = fErr
-			return
-		}
-
-		// delete invalid file
-		if deleteTempFile {
-			fErr = os.Remove(tempFilename)
-			if err == nil && fErr != nil {
-				err = fErr
-			}
-		}
-	}()
+	fh = FileHash(hex.EncodeToString(hash.Sum(nil)[:16]))
 
-	// sync file with disk
-	if err := tf.Sync(); err != nil {
-		return "", err
+	var size int64
+	if info, err := v.storage.Stat(ctx, ns, tmpKey); err == nil {
+		size = info.Size()
 	}
 
-	// calculate hash
-	hash := md5.New()
-	wr := io.MultiWriter(hash, tf)
-	if _, err := io.Copy(wr, r); err != nil {
-		return "", err
+	mType := ""
+	if mr, err := v.storage.Get(ctx, ns, tmpKey); err == nil {
+		if mt, _, err := mimetype.DetectReader(mr); err == nil {
+			mType = mt
+		}
+		mr.Close()
 	}
 
-	hashHex := hex.EncodeToString(hash.Sum(nil)[:16])
-	fh = FileHash(hashHex)
-
-	// create full path
-	err = os.MkdirAll(v.FullDir(ns, fh), defaultModePerm)
+	inserted, err := repo.UpsertHashRef(ctx, ns, string(fh), size, mType)
 	if err != nil {
+		_ = v.storage.Remove(ctx, ns, tmpKey)
 		return "", err
 	}
 
-	// move temp file to data
-	err = os.Rename(tempFilename, v.FullFile(ns, fh))
-	if err != nil {
-		return "", err
+	// the hash already has a reference on disk; this upload just bumped
+	// the refcount, so drop the duplicate bytes staged under tmpKey
+	// rather than touching the shared final key.
+	if !inserted {
+		return fh, v.storage.Remove(ctx, ns, tmpKey)
 	}
-	deleteTempFile = false
 
-	return fh, nil
+	return fh, v.storage.Rename(ctx, ns, tmpKey, fh.File())
 }
 
-func (v VFS) Path(ns, path string) string {
-	return filepath.Join(v.cfg.Path, ns, path)
-}
+// Delete decrements the reference count for fh in ns and unlinks the
+// backing file once it reaches zero, the inverse of HashUpload's
+// dedup-by-refcount scheme.
+func (v VFS) Delete(ctx context.Context, ns string, fh FileHash, repo db.VfsHashRepo) error {
+	remaining, err := repo.DecrHashRef(ctx, ns, string(fh))
+	if err != nil {
+		return err
+	}
 
-func (v VFS) FullDir(ns string, h FileHash) string {
-	return v.Path(ns, h.Dir())
-}
+	if remaining > 0 {
+		return nil
+	}
 
-func (v VFS) FullFile(ns string, h FileHash) string {
-	return v.Path(ns, h.File())
+	return v.storage.Remove(ctx, ns, fh.File())
 }
 
-func (v VFS) WebHashPath(ns string, h FileHash) string {
-	return path.Join(v.cfg.WebPath, ns, h.File())
+func (v VFS) PublicURL(ns string, h FileHash) string {
+	return v.storage.PublicURL(ns, h)
 }
 
 func (v VFS) WebPath(ns string) string {
@@ -220,7 +216,7 @@ func (v VFS) writeHashUploadResponse(w http.ResponseWriter, response UploadRespo
 	return err
 }
 
-func (v VFS) uploadFile(r *http.Request, ns, vfsFilename string) UploadResponse {
+func (v VFS) uploadFile(r *http.Request, ns, vfsFilename string, hashRepo db.VfsHashRepo) UploadResponse {
 	var (
 		fileSize  int64
 		rd        io.Reader
@@ -257,7 +253,7 @@ func (v VFS) uploadFile(r *http.Request, ns, vfsFilename string) UploadResponse
 
 	// start normal upload
 	if vfsFilename != "" {
-		err := v.Upload(rd, vfsFilename, ns)
+		err := v.Upload(r.Context(), rd, vfsFilename, ns)
 		if err != nil {
 			return UploadResponse{Error: err.Error(), Code: http.StatusBadRequest}
 		}
@@ -266,21 +262,32 @@ func (v VFS) uploadFile(r *http.Request, ns, vfsFilename string) UploadResponse
 	}
 
 	// start hash upload
-	hash, err := v.HashUpload(rd, ns)
+	hash, err := v.HashUpload(r.Context(), rd, ns, hashRepo)
 	if err != nil {
 		return UploadResponse{Error: err.Error(), Code: http.StatusBadRequest}
 	}
 
 	// write response
-	return UploadResponse{Code: http.StatusOK, Hash: string(hash), WebPath: v.WebHashPath(ns, hash)}
+	return UploadResponse{Code: http.StatusOK, Hash: string(hash), WebPath: v.PublicURL(ns, hash)}
 }
 
-func (v VFS) HashUploadHandler(w http.ResponseWriter, r *http.Request) {
-	ns := r.FormValue("ns")
-	ur := v.uploadFile(r, ns, "")
+func (v VFS) HashUploadHandler(hashRepo db.VfsHashRepo) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ns := r.FormValue("ns")
 
-	if err := v.writeHashUploadResponse(w, ur); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		var ur UploadResponse
+		switch {
+		case r.FormValue("url") != "":
+			ur = v.uploadFromURL(r.Context(), ns, r.FormValue("url"), hashRepo)
+		case strings.HasPrefix(r.FormValue("data"), "data:"):
+			ur = v.uploadFromDataURI(r.Context(), ns, r.FormValue("data"), hashRepo)
+		default:
+			ur = v.uploadFile(r, ns, "", hashRepo)
+		}
+
+		if err := v.writeHashUploadResponse(w, ur); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
 	}
 }
 
@@ -293,7 +300,7 @@ func (v VFS) UploadHandler(repo db.VfsRepo) http.HandlerFunc {
 			return
 		}
 
-		fl, err := repo.VfsFolderByID(context.Background(), folderId)
+		fl, err := repo.VfsFolderByID(r.Context(), folderId)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -306,9 +313,9 @@ func (v VFS) UploadHandler(repo db.VfsRepo) http.HandlerFunc {
 		tempFile := "temp" + randSeq(16)
 
 		// upload file
-		ur := v.uploadFile(r, ns, tempFile)
+		ur := v.uploadFile(r, ns, tempFile, nil)
 		if ur.Code == http.StatusOK {
-			id, err := v.createFile(repo, fl, ns, tempFile, ur.Name, ur.Extension)
+			id, err := v.createFile(r.Context(), repo, fl, ns, tempFile, ur.Name, ur.Extension)
 			if err != nil {
 				ur.Error = err.Error()
 				ur.Code = http.StatusInternalServerError
@@ -323,35 +330,35 @@ func (v VFS) UploadHandler(repo db.VfsRepo) http.HandlerFunc {
 	}
 }
 
-func (v VFS) createFile(repo db.VfsRepo, folder *db.VfsFolder, ns, relFilename, name, ext string) (int, error) {
+func (v VFS) createFile(ctx context.Context, repo db.VfsRepo, folder *db.VfsFolder, ns, relFilename, name, ext string) (int, error) {
 	var (
 		params *db.VfsFileParams
 		mType  string
 		fs     = 0
 	)
-	if reader, err := os.Open(v.Path(ns, relFilename)); err == nil {
-		//check for image
-		im, _, err := image.DecodeConfig(reader)
-		if err == nil {
-			params = &db.VfsFileParams{Height: im.Height, Width: im.Width}
-		} else {
-			log.Println(err)
-		}
+	if info, err := v.storage.Stat(ctx, ns, relFilename); err == nil {
+		fs = int(info.Size())
+	}
 
-		// get file size
-		if fi, err := reader.Stat(); err == nil {
-			fs = int(fi.Size())
-		}
+	// Storage.Get only guarantees an io.ReadCloser, not a seekable file, so
+	// sniffing the image header and mime type must work off a bounded read
+	// instead of buffering the whole upload into memory.
+	if reader, err := v.storage.Get(ctx, ns, relFilename); err == nil {
+		head, err := ioutil.ReadAll(io.LimitReader(reader, sniffBufferSize))
+		reader.Close()
 
-		// detect mime type
-		_, err = reader.Seek(0, io.SeekStart)
 		if err == nil {
-			if mt, _, err := mimetype.DetectReader(reader); err == nil {
+			im, _, err := image.DecodeConfig(bytes.NewReader(head))
+			if err == nil {
+				params = &db.VfsFileParams{Height: im.Height, Width: im.Width}
+			} else {
+				log.Println(err)
+			}
+
+			if mt, _, err := mimetype.DetectReader(bytes.NewReader(head)); err == nil {
 				mType = mt
 			}
 		}
-
-		reader.Close()
 	}
 
 	// get last id
@@ -371,7 +378,7 @@ func (v VFS) createFile(repo db.VfsRepo, folder *db.VfsFolder, ns, relFilename,
 	curYearMonth := time.Now().Format("200601")
 
 	// move temp file to original path
-	err = v.Move(ns, relFilename, filepath.Join(curYearMonth, filename))
+	err = v.Move(ctx, ns, relFilename, filepath.Join(curYearMonth, filename))
 	if err != nil {
 		return 0, err
 	}
@@ -390,7 +397,7 @@ func (v VFS) createFile(repo db.VfsRepo, folder *db.VfsFolder, ns, relFilename,
 		CreatedAt:  time.Now(),
 	}
 
-	vf, err := repo.AddVfsFile(context.Background(), &vfsFile)
+	vf, err := repo.AddVfsFile(ctx, &vfsFile)
 	if err != nil {
 		return 0, err
 	}
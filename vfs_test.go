@@ -0,0 +1,195 @@
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"vfs/db"
+)
+
+// memStorage is a minimal in-memory Storage used to exercise HashUpload's
+// dedup/refcount logic without touching disk.
+type memStorage struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{files: map[string][]byte{}}
+}
+
+func (s *memStorage) fullKey(ns, key string) string { return ns + "/" + key }
+
+func (s *memStorage) Put(ctx context.Context, ns, key string, r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[s.fullKey(ns, key)] = b
+	return nil
+}
+
+func (s *memStorage) Append(ctx context.Context, ns, key string, r io.Reader) (int64, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	full := s.fullKey(ns, key)
+	existing, ok := s.files[full]
+	if !ok {
+		return 0, os.ErrNotExist
+	}
+	s.files[full] = append(existing, b...)
+	return int64(len(s.files[full])), nil
+}
+
+func (s *memStorage) Get(ctx context.Context, ns, key string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.files[s.fullKey(ns, key)]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (s *memStorage) Rename(ctx context.Context, ns, oldKey, newKey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	oldFull, newFull := s.fullKey(ns, oldKey), s.fullKey(ns, newKey)
+	b, ok := s.files[oldFull]
+	if !ok {
+		return os.ErrNotExist
+	}
+	s.files[newFull] = b
+	delete(s.files, oldFull)
+	return nil
+}
+
+func (s *memStorage) Remove(ctx context.Context, ns, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	full := s.fullKey(ns, key)
+	if _, ok := s.files[full]; !ok {
+		return os.ErrNotExist
+	}
+	delete(s.files, full)
+	return nil
+}
+
+func (s *memStorage) Stat(ctx context.Context, ns, key string) (os.FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.files[s.fullKey(ns, key)]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return memFileInfo{name: key, size: int64(len(b))}, nil
+}
+
+func (s *memStorage) PublicURL(ns string, h FileHash) string { return ns + "/" + h.File() }
+
+type memFileInfo struct {
+	name string
+	size int64
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) Mode() os.FileMode  { return 0 }
+func (i memFileInfo) ModTime() time.Time { return time.Time{} }
+func (i memFileInfo) IsDir() bool        { return false }
+func (i memFileInfo) Sys() interface{}   { return nil }
+
+// memHashRepo is a minimal in-memory db.VfsHashRepo used to exercise the
+// refcount side of HashUpload's dedup logic.
+type memHashRepo struct {
+	mu   sync.Mutex
+	refs map[string]int
+}
+
+func newMemHashRepo() *memHashRepo {
+	return &memHashRepo{refs: map[string]int{}}
+}
+
+func (r *memHashRepo) key(ns, hash string) string { return ns + "/" + hash }
+
+func (r *memHashRepo) UpsertHashRef(ctx context.Context, ns, hash string, size int64, mime string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k := r.key(ns, hash)
+	_, existed := r.refs[k]
+	r.refs[k]++
+	return !existed, nil
+}
+
+func (r *memHashRepo) DecrHashRef(ctx context.Context, ns, hash string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k := r.key(ns, hash)
+	r.refs[k]--
+	return r.refs[k], nil
+}
+
+var _ db.VfsHashRepo = (*memHashRepo)(nil)
+
+// TestHashUpload_DedupKeepsFirstUploadReadable guards against the
+// data-loss regression where HashUpload's duplicate-content branch
+// removed the shared final hashed key instead of the private staging
+// key, leaving every existing reference to that hash unreadable.
+func TestHashUpload_DedupKeepsFirstUploadReadable(t *testing.T) {
+	ctx := context.Background()
+	storage := newMemStorage()
+	repo := newMemHashRepo()
+	v := VFS{cfg: Config{Namespaces: []string{"ns"}}, storage: storage}
+
+	content := []byte("identical content uploaded twice")
+
+	fh1, err := v.HashUpload(ctx, bytes.NewReader(content), "ns", repo)
+	if err != nil {
+		t.Fatalf("first HashUpload: %v", err)
+	}
+
+	fh2, err := v.HashUpload(ctx, bytes.NewReader(content), "ns", repo)
+	if err != nil {
+		t.Fatalf("second HashUpload: %v", err)
+	}
+
+	if fh1 != fh2 {
+		t.Fatalf("expected identical content to hash the same, got %q and %q", fh1, fh2)
+	}
+
+	if _, err := storage.Stat(ctx, "ns", fh1.File()); err != nil {
+		t.Fatalf("first upload's backing file is gone after a duplicate upload: %v", err)
+	}
+
+	if refcount := repo.refs[repo.key("ns", string(fh1))]; refcount != 2 {
+		t.Fatalf("expected refcount 2 after two uploads, got %d", refcount)
+	}
+
+	if err := v.Delete(ctx, "ns", fh1, repo); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := storage.Stat(ctx, "ns", fh1.File()); err != nil {
+		t.Fatalf("file removed after only one of two references was deleted: %v", err)
+	}
+
+	if err := v.Delete(ctx, "ns", fh1, repo); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := storage.Stat(ctx, "ns", fh1.File()); !os.IsNotExist(err) {
+		t.Fatalf("expected backing file to be removed once the last reference is gone, got err=%v", err)
+	}
+}